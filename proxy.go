@@ -1,9 +1,13 @@
 package offloader
 
 import (
+	"context"
 	"errors"
 	"io"
+	"log"
+	"net"
 	"net/http"
+	"net/http/httputil"
 	"strings"
 	"time"
 )
@@ -15,46 +19,330 @@ const (
 	HeaderRequestedUrl       = HeaderPrefix + "Url"
 	HeaderForwardBody        = HeaderPrefix + "Forward-Body"
 	HeaderCustomHeaderPrefix = HeaderPrefix + "X-"
+	HeaderTimeout            = HeaderPrefix + "Timeout"
+	HeaderFlushInterval      = HeaderPrefix + "Flush-Interval"
+	HeaderUpgrade            = HeaderPrefix + "Upgrade"
 )
 
+// DefaultTimeout is the timeout applied to the offload request when neither Offloader.Timeout nor the
+// Offload-Timeout response header specify one.
+const DefaultTimeout = 30 * time.Second
+
+// DefaultAllowedMethods is the set of offload methods permitted when Offloader.AllowedMethods is empty.
+var DefaultAllowedMethods = []string{http.MethodGet, http.MethodPost, http.MethodHead}
+
+// DefaultMaxOffloadHops is the maximum number of chained offload round-trips performed when Offloader.MaxOffloadHops
+// is unset.
+const DefaultMaxOffloadHops = 3
+
 var (
 	ErrInvalidVerb = errors.New("unsupported verb")
 	ErrMissingUrl  = errors.New("missing url")
+
+	// ErrTooManyHops is returned when an offload target's response itself requests further offload more times than
+	// Offloader.MaxOffloadHops allows.
+	ErrTooManyHops = errors.New("too many offload hops")
+
+	// ErrOffloadCycle is returned when a chain of offloads revisits a URL it has already requested.
+	ErrOffloadCycle = errors.New("cycle detected in offload chain")
 )
 
-// Handler offloads requests from an HTTP backend, modifying its behavior based on response headers that the backend
-// returns. It's designed to be used with httputil.ReverseProxy as a ModifyResponse function.
-func Handler(proxyResponse *http.Response) (err error) {
+// Offloader offloads requests from an HTTP backend, modifying its behavior based on response headers that the
+// backend returns. Its zero value is ready to use and behaves the same way the package-level Handler always has.
+type Offloader struct {
+	// Client, if set, is used to perform the offload request as-is. It takes precedence over Transport and
+	// Timeout, which are ignored when Client is set.
+	Client *http.Client
+
+	// Transport is used to build the offload client when Client is nil. A nil Transport uses
+	// http.DefaultTransport.
+	Transport http.RoundTripper
+
+	// Timeout bounds the offload request when Client is nil. It's overridden per-request by the backend via the
+	// Offload-Timeout response header. DefaultTimeout is used if both are unset.
+	Timeout time.Duration
+
+	// ErrorHandler, analogous to httputil.ReverseProxy.ErrorHandler, is wired into the ReverseProxy that ServeHTTP
+	// runs. It has no effect when ModifyResponse is used directly, since ModifyResponse has no access to the
+	// client's http.ResponseWriter.
+	ErrorHandler func(http.ResponseWriter, *http.Request, error)
+
+	// Logger, if set, receives diagnostic messages about offload requests.
+	Logger *log.Logger
+
+	// AllowedMethods restricts which HTTP methods the backend may request via Offload-Method. DefaultAllowedMethods
+	// is used if this is empty.
+	AllowedMethods []string
+
+	// MaxBodyBytes, if positive, caps the number of bytes read from the backend's response body when forwarding it
+	// to the offload target.
+	MaxBodyBytes int64
+
+	// Dial, if set, opens the raw connection used to perform an Offload-Upgrade handshake with the offload target.
+	// A nil Dial dials a plain TCP connection for ws:// and http:// targets, and a TLS connection for wss:// and
+	// https:// targets.
+	Dial func(network, addr string) (net.Conn, error)
+
+	// MaxOffloadHops caps the number of chained offload round-trips ModifyResponse will perform when an offload
+	// target's own response requests further offload. DefaultMaxOffloadHops is used if this is zero or negative.
+	MaxOffloadHops int
+}
+
+// Handler is a ModifyResponse function, suitable for use with httputil.ReverseProxy, backed by a zero-value
+// Offloader. It's kept for backwards compatibility; new callers should construct an Offloader directly so they can
+// configure the offload client, timeouts, and allowed methods.
+func Handler(proxyResponse *http.Response) error {
+	return (&Offloader{}).ModifyResponse(proxyResponse)
+}
+
+// ModifyResponse offloads proxyResponse to the target named in its Offload-* headers, if any, and replaces
+// proxyResponse in place with the offload target's response. If the offload target's own response in turn requests
+// further offload, ModifyResponse follows it, up to Offloader.MaxOffloadHops. It's suitable for use as
+// httputil.ReverseProxy.ModifyResponse.
+func (o *Offloader) ModifyResponse(proxyResponse *http.Response) (err error) {
 	// If offload hasn't been requested, then simply proxy the backend response to the client
 	if _, ok := proxyResponse.Header[HeaderOffloadRequested]; !ok {
 		return nil
 	}
 
-	// The response object is updated in place, so the proxy response is actually the backend response here
-	proxyRequest, err := newProxyRequestFromBackendResponse(proxyResponse)
-	if err != nil {
-		return err
+	if proxyResponse.Header.Get(HeaderUpgrade) != "" {
+		return o.serveUpgrade(proxyResponse)
 	}
 
-	// TODO: What's a reasonable timeout? Should this be configurable by the backend too?
-	c := &http.Client{
-		Timeout: 30 * time.Second,
+	origReq := proxyResponse.Request
+
+	maxHops := o.MaxOffloadHops
+	if maxHops <= 0 {
+		maxHops = DefaultMaxOffloadHops
 	}
-	offloadResponse, err := c.Do(proxyRequest)
-	if err != nil {
-		return err
+
+	// The response object is updated in place, so the proxy response is actually the backend response here. current
+	// holds whichever response we're currently following further offload from: the backend response on the first
+	// hop, and the previous hop's offload response thereafter.
+	current := proxyResponse
+	visited := make(map[string]bool, maxHops)
+	var offloadResponse *http.Response
+
+	for hops := 1; ; hops++ {
+		if hops > maxHops {
+			closeIfNotForwarded(current)
+			return ErrTooManyHops
+		}
+
+		// Build the client first: building the request clears current's headers, Offload-Timeout included.
+		offloadClient := o.client(current)
+
+		proxyRequest, err := o.newProxyRequestFromBackendResponse(current, origReq)
+		if err != nil {
+			o.logf("building offload request: %v", err)
+			closeIfNotForwarded(current)
+			return err
+		}
+
+		url := proxyRequest.URL.String()
+		if visited[url] {
+			closeIfNotForwarded(current)
+			return ErrOffloadCycle
+		}
+		visited[url] = true
+
+		offloadResponse, err = offloadClient.Do(proxyRequest)
+		closeIfNotForwarded(current)
+		if err != nil {
+			o.logf("performing offload request to %s: %v", proxyRequest.URL, err)
+			return err
+		}
+
+		if _, ok := offloadResponse.Header[HeaderOffloadRequested]; !ok {
+			break
+		}
+
+		current = offloadResponse
+	}
+
+	removeHopByHopHeaders(offloadResponse.Header)
+
+	body := offloadResponse.Body
+	if interval, ok := flushInterval(offloadResponse.Header); ok {
+		if w, ok := responseWriterFromRequest(proxyResponse.Request); ok {
+			if flusher, ok := w.(http.Flusher); ok {
+				body = &flushingReader{ReadCloser: body, flusher: flusher, interval: interval}
+			} else {
+				o.logf("Offload-Flush-Interval set but the client's ResponseWriter doesn't support flushing")
+			}
+		} else {
+			o.logf("Offload-Flush-Interval set but no http.ResponseWriter is available; use Offloader.ServeHTTP")
+		}
 	}
 
 	proxyResponse.Header = offloadResponse.Header
 	proxyResponse.StatusCode = offloadResponse.StatusCode
-	proxyResponse.Body = offloadResponse.Body
+	proxyResponse.Body = body
 
 	return nil
 }
 
-func newProxyRequestFromBackendResponse(backendResponse *http.Response) (*http.Request, error) {
+// ServeHTTP runs proxy, which the caller configures to route to the real backend as usual, wiring up
+// o.ModifyResponse and o.ErrorHandler and threading w through the request context so that ModifyResponse can
+// honor Offload-Flush-Interval and Offload-Upgrade. Use this instead of calling proxy.ServeHTTP directly whenever
+// flushing or upgrade support is needed; ModifyResponse alone has no access to w.
+func (o *Offloader) ServeHTTP(proxy *httputil.ReverseProxy, w http.ResponseWriter, r *http.Request) {
+	o.Wrap(proxy).ServeHTTP(w, r)
+}
+
+// Wrap adapts next, typically an *httputil.ReverseProxy pointed at the real backend, into an http.Handler that
+// threads w through the request context so that ModifyResponse can honor Offload-Flush-Interval and
+// Offload-Upgrade. If next is an *httputil.ReverseProxy, Wrap also configures its ModifyResponse and ErrorHandler.
+func (o *Offloader) Wrap(next http.Handler) http.Handler {
+	if proxy, ok := next.(*httputil.ReverseProxy); ok {
+		proxy.ModifyResponse = o.ModifyResponse
+		proxy.ErrorHandler = o.handleProxyError
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(withResponseWriter(r.Context(), w)))
+	})
+}
+
+// handleProxyError is installed as the ReverseProxy's ErrorHandler by Wrap. serveUpgrade reports a successfully
+// served upgrade as an error so that ReverseProxy won't also try to write its own response on the now-hijacked
+// connection; handleProxyError recognizes that case and does nothing, deferring everything else to o.ErrorHandler.
+// If o.ErrorHandler is unset, it logs the error to o.Logger (if set) and responds 502 Bad Gateway.
+func (o *Offloader) handleProxyError(w http.ResponseWriter, r *http.Request, err error) {
+	if err == errUpgradeServed {
+		return
+	}
+
+	if o.ErrorHandler != nil {
+		o.ErrorHandler(w, r, err)
+		return
+	}
+
+	o.logf("http: proxy error: %v", err)
+	w.WriteHeader(http.StatusBadGateway)
+}
+
+func (o *Offloader) logf(format string, args ...interface{}) {
+	if o.Logger != nil {
+		o.Logger.Printf(format, args...)
+	}
+}
+
+// client builds the http.Client used to perform the offload request named by backendResponse, honoring
+// Offloader.Client, Offloader.Transport, Offloader.Timeout, and an Offload-Timeout override from the backend.
+func (o *Offloader) client(backendResponse *http.Response) *http.Client {
+	if o.Client != nil {
+		return o.Client
+	}
+
+	timeout := o.Timeout
+	if raw := backendResponse.Header.Get(HeaderTimeout); raw != "" {
+		if parsed, err := time.ParseDuration(raw); err == nil {
+			timeout = parsed
+		} else {
+			o.logf("ignoring invalid %s header %q: %v", HeaderTimeout, raw, err)
+		}
+	}
+	if timeout == 0 {
+		timeout = DefaultTimeout
+	}
+
+	return &http.Client{
+		Transport: o.Transport,
+		Timeout:   timeout,
+	}
+}
+
+type contextKey int
+
+const responseWriterContextKey contextKey = iota
+
+// withResponseWriter returns a copy of ctx carrying w, so that it can later be recovered from the request that
+// ModifyResponse receives via http.Response.Request.
+func withResponseWriter(ctx context.Context, w http.ResponseWriter) context.Context {
+	return context.WithValue(ctx, responseWriterContextKey, w)
+}
+
+// responseWriterFromRequest recovers the http.ResponseWriter stashed on req's context by Offloader.ServeHTTP, if
+// any. req may be nil when ModifyResponse is exercised directly against a hand-built http.Response.
+func responseWriterFromRequest(req *http.Request) (http.ResponseWriter, bool) {
+	if req == nil {
+		return nil, false
+	}
+	w, ok := req.Context().Value(responseWriterContextKey).(http.ResponseWriter)
+	return w, ok
+}
+
+// flushInterval reports the duration named by h's Offload-Flush-Interval header, if present and valid, removing
+// the header either way so it doesn't leak to the client.
+func flushInterval(h http.Header) (time.Duration, bool) {
+	raw := h.Get(HeaderFlushInterval)
+	h.Del(HeaderFlushInterval)
+	if raw == "" {
+		return 0, false
+	}
+
+	d, err := time.ParseDuration(raw)
+	if err != nil || d <= 0 {
+		return 0, false
+	}
+
+	return d, true
+}
+
+// flushingReader wraps an offload response body, flushing the downstream http.ResponseWriter after reads that
+// are spaced at least interval apart. This lets a slow or large offload response start reaching the client
+// before the whole body has arrived, mirroring httputil.ReverseProxy's FlushInterval.
+type flushingReader struct {
+	io.ReadCloser
+	flusher   http.Flusher
+	interval  time.Duration
+	lastFlush time.Time
+}
+
+func (r *flushingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if n > 0 && time.Since(r.lastFlush) >= r.interval {
+		r.flusher.Flush()
+		r.lastFlush = time.Now()
+	}
+	return n, err
+}
+
+// closeIfNotForwarded closes resp's body unless Offload-Forward-Body asked for it to be forwarded as the next
+// offload request's body, in which case sending that request has already consumed (and closed) it. resp.Body is
+// nil for hand-built responses in tests, which is harmless to skip.
+func closeIfNotForwarded(resp *http.Response) {
+	if resp.Body == nil {
+		return
+	}
+	if _, forwarded := resp.Header[HeaderForwardBody]; forwarded {
+		return
+	}
+	resp.Body.Close()
+}
+
+// hopHeaders are headers that are meaningful only for a single hop, not to clients or servers beyond the
+// immediate connection. They're stripped from both the request sent to the offload target and the response
+// relayed back to the client, mirroring net/http/httputil.ReverseProxy's own handling.
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// newProxyRequestFromBackendResponse builds the outgoing offload request named by backendResponse's Offload-*
+// headers. origReq, the original client request, supplies the context (so client cancellation propagates through
+// every hop of a chained offload) and the data behind the X-Forwarded-* headers; it may be nil, e.g. when
+// ModifyResponse is exercised directly against a hand-built http.Response.
+func (o *Offloader) newProxyRequestFromBackendResponse(backendResponse *http.Response, origReq *http.Request) (*http.Request, error) {
 	method := strings.ToUpper(backendResponse.Header.Get(HeaderRequestedMethod))
-	if !isSupportedMethod(method) {
+	if !o.isSupportedMethod(method) {
 		return nil, ErrInvalidVerb
 	}
 
@@ -65,25 +353,49 @@ func newProxyRequestFromBackendResponse(backendResponse *http.Response) (*http.R
 
 	var body io.Reader
 	if _, ok := backendResponse.Header[HeaderForwardBody]; ok {
-		body = backendResponse.Body
+		body = o.limitBody(backendResponse.Body)
 	}
 
-	proxyRequest, err := http.NewRequest(method, url, body)
+	ctx := context.Background()
+	if origReq != nil {
+		ctx = origReq.Context()
+	}
+
+	proxyRequest, err := http.NewRequestWithContext(ctx, method, url, body)
 	if err != nil {
 		return nil, err
 	}
 
-	prepareProxyRequestHeaders(proxyRequest, backendResponse)
+	prepareProxyRequestHeaders(proxyRequest, backendResponse, origReq)
 
 	return proxyRequest, nil
 }
 
-func prepareProxyRequestHeaders(proxyRequest *http.Request, backendResponse *http.Response) {
+// limitBody caps body at MaxBodyBytes when it's positive, leaving it untouched otherwise.
+func (o *Offloader) limitBody(body io.ReadCloser) io.ReadCloser {
+	if o.MaxBodyBytes <= 0 || body == nil {
+		return body
+	}
+
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(body, o.MaxBodyBytes), body}
+}
+
+// prepareProxyRequestHeaders populates proxyRequest's headers from backendResponse's Offload-X-* headers,
+// stripping hop-by-hop headers along the way, and adds X-Forwarded-* headers describing origReq, the original
+// client request.
+func prepareProxyRequestHeaders(proxyRequest *http.Request, backendResponse *http.Response, origReq *http.Request) {
+	forbidden := hopByHopHeaderSet(backendResponse.Header)
+
 	preservedHeaders := map[string]string{}
 	for key, val := range backendResponse.Header {
 		if strings.HasPrefix(key, HeaderCustomHeaderPrefix) {
 			trimmedKey := strings.TrimPrefix(key, HeaderCustomHeaderPrefix)
-			preservedHeaders[trimmedKey] = val[0]
+			if !forbidden[http.CanonicalHeaderKey(trimmedKey)] {
+				preservedHeaders[trimmedKey] = val[0]
+			}
 		}
 
 		// Clear out all existing response headers from the backend
@@ -95,17 +407,75 @@ func prepareProxyRequestHeaders(proxyRequest *http.Request, backendResponse *htt
 	for key, val := range preservedHeaders {
 		proxyRequest.Header.Set(key, val)
 	}
+
+	addForwardingHeaders(proxyRequest, origReq)
+}
+
+// addForwardingHeaders sets X-Forwarded-For, X-Forwarded-Host, and X-Forwarded-Proto on proxyRequest based on
+// origReq, the original client request. origReq may be nil (e.g. when a backendResponse was built by hand in a
+// test), in which case no forwarding headers are added.
+func addForwardingHeaders(proxyRequest *http.Request, origReq *http.Request) {
+	if origReq == nil {
+		return
+	}
+
+	if clientIP, _, err := net.SplitHostPort(origReq.RemoteAddr); err == nil {
+		if prior := origReq.Header.Get("X-Forwarded-For"); prior != "" {
+			clientIP = prior + ", " + clientIP
+		}
+		proxyRequest.Header.Set("X-Forwarded-For", clientIP)
+	}
+
+	if origReq.Host != "" {
+		proxyRequest.Header.Set("X-Forwarded-Host", origReq.Host)
+	}
+
+	proto := "http"
+	if origReq.TLS != nil {
+		proto = "https"
+	}
+	proxyRequest.Header.Set("X-Forwarded-Proto", proto)
 }
 
-func isSupportedMethod(verb string) bool {
-	switch verb {
-	case http.MethodGet:
-		return true
-	case http.MethodPost:
-		return true
-	case http.MethodHead:
-		return true
-	default:
-		return false
+// removeHopByHopHeaders strips the headers listed in hopHeaders, as well as any extra headers named by the
+// Connection header, from h. This mirrors net/http/httputil.ReverseProxy, which performs the same stripping in
+// both directions of a proxied request.
+func removeHopByHopHeaders(h http.Header) {
+	for name := range hopByHopHeaderSet(h) {
+		h.Del(name)
 	}
 }
+
+// hopByHopHeaderSet returns the canonical names of hopHeaders plus any extra headers named by h's Connection
+// header.
+func hopByHopHeaderSet(h http.Header) map[string]bool {
+	forbidden := make(map[string]bool, len(hopHeaders))
+	for _, name := range hopHeaders {
+		forbidden[http.CanonicalHeaderKey(name)] = true
+	}
+
+	if c := h.Get("Connection"); c != "" {
+		for _, name := range strings.Split(c, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				forbidden[http.CanonicalHeaderKey(name)] = true
+			}
+		}
+	}
+
+	return forbidden
+}
+
+func (o *Offloader) isSupportedMethod(verb string) bool {
+	allowed := o.AllowedMethods
+	if len(allowed) == 0 {
+		allowed = DefaultAllowedMethods
+	}
+
+	for _, m := range allowed {
+		if strings.EqualFold(m, verb) {
+			return true
+		}
+	}
+
+	return false
+}
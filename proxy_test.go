@@ -1,7 +1,9 @@
 package offloader
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
@@ -9,6 +11,7 @@ import (
 	"net/url"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestEndToEnd(t *testing.T) {
@@ -74,6 +77,44 @@ func TestEndToEnd(t *testing.T) {
 	}
 }
 
+func TestEndToEndStripsHopByHopResponseHeaders(t *testing.T) {
+	offloadServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Connection", "X-Secret-Header")
+		w.Header().Set("X-Secret-Header", "should-not-reach-client")
+		w.Header().Set("Keep-Alive", "timeout=5")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer offloadServer.Close()
+
+	backendServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(HeaderOffloadRequested, "1")
+		w.Header().Set(HeaderRequestedUrl, offloadServer.URL)
+		w.Header().Set(HeaderRequestedMethod, http.MethodGet)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer backendServer.Close()
+
+	target, _ := url.Parse(backendServer.URL)
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	proxy.ModifyResponse = Handler
+
+	request, err := http.NewRequest("GET", "http://doesntmatter/foo", nil)
+	if err != nil {
+		t.Fatalf("unexpected request error: %v", err)
+	}
+
+	rw := httptest.NewRecorder()
+	proxy.ServeHTTP(rw, request)
+
+	if got := rw.Header().Get("X-Secret-Header"); got != "" {
+		t.Errorf("hop-by-hop header leaked to client: got %q", got)
+	}
+
+	if got := rw.Header().Get("Keep-Alive"); got != "" {
+		t.Errorf("hop-by-hop header leaked to client: got %q", got)
+	}
+}
+
 func TestNewProxyRequestFromBackendResponse(t *testing.T) {
 	t.Run("proxy request has the expected URL", func(t *testing.T) {
 		offloadUrl := "http://some-slow-service?foo=bar&baz=quux"
@@ -86,7 +127,7 @@ func TestNewProxyRequestFromBackendResponse(t *testing.T) {
 			},
 		}
 
-		r, err := newProxyRequestFromBackendResponse(resp)
+		r, err := (&Offloader{}).newProxyRequestFromBackendResponse(resp, resp.Request)
 
 		if err != nil {
 			t.Fatalf("unexpected error: %v", err)
@@ -116,7 +157,7 @@ func TestNewProxyRequestFromBackendResponse(t *testing.T) {
 			},
 		}
 
-		r, err := newProxyRequestFromBackendResponse(resp)
+		r, err := (&Offloader{}).newProxyRequestFromBackendResponse(resp, resp.Request)
 		if err != nil {
 			t.Fatalf("unexpected error: %v", err)
 		}
@@ -143,7 +184,7 @@ func TestNewProxyRequestFromBackendResponse(t *testing.T) {
 			},
 		}
 
-		r, err := newProxyRequestFromBackendResponse(backendResponse)
+		r, err := (&Offloader{}).newProxyRequestFromBackendResponse(backendResponse, backendResponse.Request)
 		if err != nil {
 			t.Fatalf("unexpected error: %v", err)
 		}
@@ -166,7 +207,7 @@ func TestNewProxyRequestFromBackendResponse(t *testing.T) {
 			},
 		}
 
-		_, err := newProxyRequestFromBackendResponse(resp)
+		_, err := (&Offloader{}).newProxyRequestFromBackendResponse(resp, resp.Request)
 
 		if err != nil {
 			t.Fatalf("unexpected error: %v", err)
@@ -182,7 +223,7 @@ func TestNewProxyRequestFromBackendResponse(t *testing.T) {
 			},
 		}
 
-		_, err := newProxyRequestFromBackendResponse(resp)
+		_, err := (&Offloader{}).newProxyRequestFromBackendResponse(resp, resp.Request)
 
 		if err != ErrInvalidVerb {
 			t.Fatalf("expected error %v but got %v instead", ErrInvalidVerb, err)
@@ -198,7 +239,7 @@ func TestNewProxyRequestFromBackendResponse(t *testing.T) {
 			},
 		}
 
-		_, err := newProxyRequestFromBackendResponse(resp)
+		_, err := (&Offloader{}).newProxyRequestFromBackendResponse(resp, resp.Request)
 
 		if err != nil {
 			t.Fatalf("unexpected error: %v", err)
@@ -213,7 +254,7 @@ func TestNewProxyRequestFromBackendResponse(t *testing.T) {
 			},
 		}
 
-		_, err := newProxyRequestFromBackendResponse(resp)
+		_, err := (&Offloader{}).newProxyRequestFromBackendResponse(resp, resp.Request)
 
 		if err != ErrMissingUrl {
 			t.Fatalf("expected error %v but got %v instead", ErrMissingUrl, err)
@@ -238,7 +279,7 @@ func TestPrepareProxyRequestHeaders(t *testing.T) {
 			Header: http.Header{},
 		}
 
-		prepareProxyRequestHeaders(proxyRequest, backendResponse)
+		prepareProxyRequestHeaders(proxyRequest, backendResponse, backendResponse.Request)
 
 		if actualHeaderValue := proxyRequest.Header.Get(expectedHeaderKey); actualHeaderValue != expectedHeaderValue {
 			t.Errorf("expected header '%s' not found or has incorrect value: got '%s' but wanted '%s'", expectedHeaderKey, actualHeaderValue, expectedHeaderValue)
@@ -265,10 +306,561 @@ func TestPrepareProxyRequestHeaders(t *testing.T) {
 			},
 		}
 
-		prepareProxyRequestHeaders(proxyRequest, backendResponse)
+		prepareProxyRequestHeaders(proxyRequest, backendResponse, backendResponse.Request)
 
 		if actualHeaderValue := proxyRequest.Header.Get(expectedHeaderKey); actualHeaderValue != expectedHeaderValue {
 			t.Errorf("expected header '%s' not found or has incorrect value: got '%s' but wanted '%s'", expectedHeaderKey, actualHeaderValue, expectedHeaderValue)
 		}
 	})
+
+	t.Run("strips hop-by-hop headers named by the backend", func(t *testing.T) {
+		for _, hopHeader := range hopHeaders {
+			backendResponse := &http.Response{
+				Header: http.Header{
+					HeaderCustomHeaderPrefix + hopHeader: []string{"should-not-survive"},
+				},
+			}
+
+			proxyRequest := &http.Request{Header: http.Header{}}
+
+			prepareProxyRequestHeaders(proxyRequest, backendResponse, backendResponse.Request)
+
+			if got := proxyRequest.Header.Get(hopHeader); got != "" {
+				t.Errorf("hop-by-hop header %q leaked through: got %q", hopHeader, got)
+			}
+		}
+	})
+
+	t.Run("strips headers named by the Connection header", func(t *testing.T) {
+		backendResponse := &http.Response{
+			Header: http.Header{
+				"Connection": []string{"X-Custom-Hop"},
+				HeaderCustomHeaderPrefix + "x-custom-hop": []string{"should-not-survive"},
+			},
+		}
+
+		proxyRequest := &http.Request{Header: http.Header{}}
+
+		prepareProxyRequestHeaders(proxyRequest, backendResponse, backendResponse.Request)
+
+		if got := proxyRequest.Header.Get("X-Custom-Hop"); got != "" {
+			t.Errorf("header named by Connection leaked through: got %q", got)
+		}
+	})
+
+	t.Run("adds X-Forwarded-* headers derived from the original client request", func(t *testing.T) {
+		origReq := &http.Request{
+			Host:       "original-host.example.com",
+			RemoteAddr: "203.0.113.5:54321",
+			Header:     http.Header{"X-Forwarded-For": []string{"198.51.100.9"}},
+		}
+		backendResponse := &http.Response{
+			Header:  http.Header{},
+			Request: origReq,
+		}
+
+		proxyRequest := &http.Request{Header: http.Header{}}
+
+		prepareProxyRequestHeaders(proxyRequest, backendResponse, backendResponse.Request)
+
+		if got, want := proxyRequest.Header.Get("X-Forwarded-Host"), "original-host.example.com"; got != want {
+			t.Errorf("X-Forwarded-Host: got %q, wanted %q", got, want)
+		}
+
+		if got, want := proxyRequest.Header.Get("X-Forwarded-Proto"), "http"; got != want {
+			t.Errorf("X-Forwarded-Proto: got %q, wanted %q", got, want)
+		}
+
+		if got, want := proxyRequest.Header.Get("X-Forwarded-For"), "198.51.100.9, 203.0.113.5"; got != want {
+			t.Errorf("X-Forwarded-For: got %q, wanted %q", got, want)
+		}
+	})
+
+	t.Run("doesn't panic when the original request is unavailable", func(t *testing.T) {
+		backendResponse := &http.Response{Header: http.Header{}}
+		proxyRequest := &http.Request{Header: http.Header{}}
+
+		prepareProxyRequestHeaders(proxyRequest, backendResponse, backendResponse.Request)
+
+		if got := proxyRequest.Header.Get("X-Forwarded-Host"); got != "" {
+			t.Errorf("expected no X-Forwarded-Host without an original request, got %q", got)
+		}
+	})
+}
+
+func TestRemoveHopByHopHeaders(t *testing.T) {
+	h := http.Header{}
+	for _, name := range hopHeaders {
+		h.Set(name, "1")
+	}
+	h.Set("X-Regular-Header", "1")
+
+	removeHopByHopHeaders(h)
+
+	for _, name := range hopHeaders {
+		if h.Get(name) != "" {
+			t.Errorf("expected hop-by-hop header %q to be removed", name)
+		}
+	}
+
+	if h.Get("X-Regular-Header") == "" {
+		t.Errorf("expected non-hop-by-hop header to survive")
+	}
+}
+
+func TestOffloaderIsSupportedMethod(t *testing.T) {
+	t.Run("falls back to DefaultAllowedMethods when unset", func(t *testing.T) {
+		o := &Offloader{}
+
+		if !o.isSupportedMethod(http.MethodGet) {
+			t.Errorf("expected %s to be supported by default", http.MethodGet)
+		}
+
+		if o.isSupportedMethod(http.MethodDelete) {
+			t.Errorf("expected %s not to be supported by default", http.MethodDelete)
+		}
+	})
+
+	t.Run("honors a custom AllowedMethods list", func(t *testing.T) {
+		o := &Offloader{AllowedMethods: []string{http.MethodDelete}}
+
+		if !o.isSupportedMethod(http.MethodDelete) {
+			t.Errorf("expected %s to be supported", http.MethodDelete)
+		}
+
+		if o.isSupportedMethod(http.MethodGet) {
+			t.Errorf("expected %s not to be supported once AllowedMethods is set", http.MethodGet)
+		}
+	})
+}
+
+func TestOffloaderClient(t *testing.T) {
+	t.Run("uses Client as-is when set", func(t *testing.T) {
+		custom := &http.Client{Timeout: time.Hour}
+		o := &Offloader{Client: custom}
+
+		if got := o.client(&http.Response{Header: http.Header{}}); got != custom {
+			t.Errorf("expected the configured Client to be used unchanged")
+		}
+	})
+
+	t.Run("falls back to DefaultTimeout", func(t *testing.T) {
+		o := &Offloader{}
+
+		c := o.client(&http.Response{Header: http.Header{}})
+
+		if c.Timeout != DefaultTimeout {
+			t.Errorf("got timeout %v, wanted %v", c.Timeout, DefaultTimeout)
+		}
+	})
+
+	t.Run("backend can override the timeout via Offload-Timeout", func(t *testing.T) {
+		o := &Offloader{Timeout: time.Minute}
+
+		backendResponse := &http.Response{
+			Header: http.Header{HeaderTimeout: []string{"5s"}},
+		}
+		c := o.client(backendResponse)
+
+		if c.Timeout != 5*time.Second {
+			t.Errorf("got timeout %v, wanted %v", c.Timeout, 5*time.Second)
+		}
+	})
+
+	t.Run("ignores an invalid Offload-Timeout", func(t *testing.T) {
+		o := &Offloader{Timeout: time.Minute}
+
+		backendResponse := &http.Response{
+			Header: http.Header{HeaderTimeout: []string{"not-a-duration"}},
+		}
+		c := o.client(backendResponse)
+
+		if c.Timeout != time.Minute {
+			t.Errorf("got timeout %v, wanted %v", c.Timeout, time.Minute)
+		}
+	})
+}
+
+func TestOffloaderMaxBodyBytes(t *testing.T) {
+	offloadServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprint(w, string(body))
+	}))
+	defer offloadServer.Close()
+
+	backendServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(HeaderOffloadRequested, "1")
+		w.Header().Set(HeaderRequestedUrl, offloadServer.URL)
+		w.Header().Set(HeaderForwardBody, "1")
+		w.Header().Set(HeaderRequestedMethod, http.MethodPost)
+
+		fmt.Fprint(w, "0123456789")
+	}))
+	defer backendServer.Close()
+
+	target, _ := url.Parse(backendServer.URL)
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	o := &Offloader{MaxBodyBytes: 4}
+	proxy.ModifyResponse = o.ModifyResponse
+
+	request, err := http.NewRequest("GET", "http://doesntmatter/foo", nil)
+	if err != nil {
+		t.Fatalf("unexpected request error: %v", err)
+	}
+
+	rw := httptest.NewRecorder()
+	proxy.ServeHTTP(rw, request)
+
+	body, err := ioutil.ReadAll(rw.Body)
+	if err != nil {
+		t.Fatalf("unexpected read error: %v", err)
+	}
+
+	if string(body) != "0123" {
+		t.Errorf("got body %q, wanted %q", body, "0123")
+	}
+}
+
+func TestOffloadRequestCancellationPropagates(t *testing.T) {
+	observed := make(chan error, 1)
+	offloadServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+		observed <- r.Context().Err()
+	}))
+	defer offloadServer.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	origReq := httptest.NewRequest(http.MethodGet, "http://client.example", nil).WithContext(ctx)
+
+	backendResponse := &http.Response{
+		Header: http.Header{
+			HeaderOffloadRequested: []string{"1"},
+			HeaderRequestedMethod:  []string{"GET"},
+			HeaderRequestedUrl:     []string{offloadServer.URL},
+		},
+		Request: origReq,
+	}
+
+	proxyRequest, err := (&Offloader{}).newProxyRequestFromBackendResponse(backendResponse, backendResponse.Request)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := http.DefaultClient.Do(proxyRequest)
+		done <- err
+	}()
+
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+
+	select {
+	case err := <-observed:
+		if err != context.Canceled {
+			t.Errorf("expected the offload target to observe context.Canceled, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for the offload target to observe cancellation")
+	}
+
+	<-done
+}
+
+// flushRecorder wraps httptest.ResponseRecorder, recording the body length observed at each Flush call so tests
+// can assert that a response arrived in more than one chunk.
+type flushRecorder struct {
+	*httptest.ResponseRecorder
+	boundaries []int
+}
+
+func newFlushRecorder() *flushRecorder {
+	return &flushRecorder{ResponseRecorder: httptest.NewRecorder()}
+}
+
+func (r *flushRecorder) Flush() {
+	r.boundaries = append(r.boundaries, r.Body.Len())
+	r.ResponseRecorder.Flush()
+}
+
+func TestServeHTTPStreamsWithFlushInterval(t *testing.T) {
+	offloadServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(HeaderFlushInterval, "1ms")
+		flusher := w.(http.Flusher)
+		for i := 0; i < 3; i++ {
+			fmt.Fprintf(w, "chunk%d;", i)
+			flusher.Flush()
+			time.Sleep(20 * time.Millisecond)
+		}
+	}))
+	defer offloadServer.Close()
+
+	backendServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(HeaderOffloadRequested, "1")
+		w.Header().Set(HeaderRequestedUrl, offloadServer.URL)
+		w.Header().Set(HeaderRequestedMethod, http.MethodGet)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer backendServer.Close()
+
+	target, err := url.Parse(backendServer.URL)
+	if err != nil {
+		t.Fatalf("unexpected url parse error: %v", err)
+	}
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	o := &Offloader{}
+
+	request, err := http.NewRequest("GET", "http://doesntmatter/foo", nil)
+	if err != nil {
+		t.Fatalf("unexpected request error: %v", err)
+	}
+
+	rw := newFlushRecorder()
+	o.ServeHTTP(proxy, rw, request)
+
+	if len(rw.boundaries) < 2 {
+		t.Fatalf("expected at least 2 flushes, got %d (boundaries=%v)", len(rw.boundaries), rw.boundaries)
+	}
+
+	if got, want := rw.Body.String(), "chunk0;chunk1;chunk2;"; got != want {
+		t.Errorf("got body %q, wanted %q", got, want)
+	}
+
+	if rw.Header().Get(HeaderFlushInterval) != "" {
+		t.Errorf("expected %s not to leak to the client", HeaderFlushInterval)
+	}
+}
+
+// newOffloadHopServer returns an httptest.Server that either requests further offload to next, if next is
+// non-empty, or writes body as a plain 200 response, terminating the chain.
+func newOffloadHopServer(next, body string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if next != "" {
+			w.Header().Set(HeaderOffloadRequested, "1")
+			w.Header().Set(HeaderRequestedUrl, next)
+			w.Header().Set(HeaderRequestedMethod, http.MethodGet)
+			return
+		}
+		fmt.Fprint(w, body)
+	}))
+}
+
+func TestModifyResponseChainedOffloads(t *testing.T) {
+	t.Run("stops after zero further hops when the offload target doesn't request more offload", func(t *testing.T) {
+		final := newOffloadHopServer("", "done")
+		defer final.Close()
+
+		backendServer := newOffloadHopServer(final.URL, "")
+		defer backendServer.Close()
+
+		target, _ := url.Parse(backendServer.URL)
+		proxy := httputil.NewSingleHostReverseProxy(target)
+		proxy.ModifyResponse = Handler
+
+		rw := httptest.NewRecorder()
+		request, _ := http.NewRequest("GET", "http://doesntmatter/", nil)
+		proxy.ServeHTTP(rw, request)
+
+		if body, _ := ioutil.ReadAll(rw.Body); string(body) != "done" {
+			t.Errorf("got body %q, wanted %q", body, "done")
+		}
+	})
+
+	t.Run("follows a single further hop", func(t *testing.T) {
+		final := newOffloadHopServer("", "done")
+		defer final.Close()
+		hop1 := newOffloadHopServer(final.URL, "")
+		defer hop1.Close()
+
+		backendServer := newOffloadHopServer(hop1.URL, "")
+		defer backendServer.Close()
+
+		target, _ := url.Parse(backendServer.URL)
+		proxy := httputil.NewSingleHostReverseProxy(target)
+		proxy.ModifyResponse = Handler
+
+		rw := httptest.NewRecorder()
+		request, _ := http.NewRequest("GET", "http://doesntmatter/", nil)
+		proxy.ServeHTTP(rw, request)
+
+		if body, _ := ioutil.ReadAll(rw.Body); string(body) != "done" {
+			t.Errorf("got body %q, wanted %q", body, "done")
+		}
+	})
+
+	t.Run("follows N hops up to MaxOffloadHops", func(t *testing.T) {
+		final := newOffloadHopServer("", "done")
+		defer final.Close()
+		hop2 := newOffloadHopServer(final.URL, "")
+		defer hop2.Close()
+		hop1 := newOffloadHopServer(hop2.URL, "")
+		defer hop1.Close()
+
+		backendServer := newOffloadHopServer(hop1.URL, "")
+		defer backendServer.Close()
+
+		target, _ := url.Parse(backendServer.URL)
+		proxy := httputil.NewSingleHostReverseProxy(target)
+		o := &Offloader{MaxOffloadHops: 4}
+		proxy.ModifyResponse = o.ModifyResponse
+
+		rw := httptest.NewRecorder()
+		request, _ := http.NewRequest("GET", "http://doesntmatter/", nil)
+		proxy.ServeHTTP(rw, request)
+
+		if body, _ := ioutil.ReadAll(rw.Body); string(body) != "done" {
+			t.Errorf("got body %q, wanted %q", body, "done")
+		}
+	})
+
+	t.Run("returns ErrTooManyHops once the chain exceeds MaxOffloadHops", func(t *testing.T) {
+		final := newOffloadHopServer("", "done")
+		defer final.Close()
+		hop2 := newOffloadHopServer(final.URL, "")
+		defer hop2.Close()
+		hop1 := newOffloadHopServer(hop2.URL, "")
+		defer hop1.Close()
+
+		backendResponse := &http.Response{
+			Header: http.Header{
+				HeaderOffloadRequested: []string{"1"},
+				HeaderRequestedUrl:     []string{hop1.URL},
+				HeaderRequestedMethod:  []string{http.MethodGet},
+			},
+		}
+
+		transport := &closeCountingTransport{next: http.DefaultTransport}
+		o := &Offloader{MaxOffloadHops: 2, Transport: transport}
+		if err := o.ModifyResponse(backendResponse); err != ErrTooManyHops {
+			t.Errorf("expected %v, got %v", ErrTooManyHops, err)
+		}
+
+		if transport.fetched < 2 {
+			t.Fatalf("test didn't exercise the intended scenario: only fetched %d responses", transport.fetched)
+		}
+		if transport.closed != transport.fetched {
+			t.Errorf("closed %d of %d fetched intermediate response bodies", transport.closed, transport.fetched)
+		}
+	})
+
+	t.Run("returns ErrOffloadCycle when a chain revisits a URL", func(t *testing.T) {
+		var looper *httptest.Server
+		looper = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set(HeaderOffloadRequested, "1")
+			w.Header().Set(HeaderRequestedUrl, looper.URL)
+			w.Header().Set(HeaderRequestedMethod, http.MethodGet)
+		}))
+		defer looper.Close()
+
+		backendResponse := &http.Response{
+			Header: http.Header{
+				HeaderOffloadRequested: []string{"1"},
+				HeaderRequestedUrl:     []string{looper.URL},
+				HeaderRequestedMethod:  []string{http.MethodGet},
+			},
+		}
+
+		transport := &closeCountingTransport{next: http.DefaultTransport}
+		o := &Offloader{Transport: transport}
+		if err := o.ModifyResponse(backendResponse); err != ErrOffloadCycle {
+			t.Errorf("expected %v, got %v", ErrOffloadCycle, err)
+		}
+
+		if transport.fetched < 1 {
+			t.Fatalf("test didn't exercise the intended scenario: only fetched %d responses", transport.fetched)
+		}
+		if transport.closed != transport.fetched {
+			t.Errorf("closed %d of %d fetched intermediate response bodies", transport.closed, transport.fetched)
+		}
+	})
+}
+
+// closeTrackingBody wraps an io.ReadCloser, recording whether Close was called on it.
+type closeTrackingBody struct {
+	io.ReadCloser
+	closed *bool
+}
+
+func (b *closeTrackingBody) Close() error {
+	*b.closed = true
+	return b.ReadCloser.Close()
+}
+
+// closeTrackingTransport wraps an http.RoundTripper, tagging every response body it returns with a
+// closeTrackingBody so tests can assert it was closed.
+type closeTrackingTransport struct {
+	next   http.RoundTripper
+	closed *bool
+}
+
+func (t *closeTrackingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(r)
+	if err != nil {
+		return resp, err
+	}
+	resp.Body = &closeTrackingBody{ReadCloser: resp.Body, closed: t.closed}
+	return resp, nil
+}
+
+// closeCountingTransport wraps an http.RoundTripper, counting how many response bodies it has returned and how
+// many of those have since been closed, so tests can assert every fetched intermediate response was cleaned up.
+type closeCountingTransport struct {
+	next    http.RoundTripper
+	fetched int
+	closed  int
+}
+
+func (t *closeCountingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(r)
+	if err != nil {
+		return resp, err
+	}
+	t.fetched++
+	resp.Body = &closeCountingBody{ReadCloser: resp.Body, transport: t}
+	return resp, nil
+}
+
+// closeCountingBody wraps an io.ReadCloser, incrementing its transport's closed count when Close is called.
+type closeCountingBody struct {
+	io.ReadCloser
+	transport *closeCountingTransport
+}
+
+func (b *closeCountingBody) Close() error {
+	b.transport.closed++
+	return b.ReadCloser.Close()
+}
+
+func TestModifyResponseClosesBackendResponseBodyWhenNotForwarded(t *testing.T) {
+	offloadServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "offloaded")
+	}))
+	defer offloadServer.Close()
+
+	backendServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(HeaderOffloadRequested, "1")
+		w.Header().Set(HeaderRequestedUrl, offloadServer.URL)
+		w.Header().Set(HeaderRequestedMethod, http.MethodGet)
+		fmt.Fprint(w, "backend body, not forwarded")
+	}))
+	defer backendServer.Close()
+
+	target, _ := url.Parse(backendServer.URL)
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	proxy.ModifyResponse = Handler
+
+	var closed bool
+	proxy.Transport = &closeTrackingTransport{next: http.DefaultTransport, closed: &closed}
+
+	rw := httptest.NewRecorder()
+	request, _ := http.NewRequest("GET", "http://doesntmatter/", nil)
+	proxy.ServeHTTP(rw, request)
+
+	if !closed {
+		t.Errorf("expected the backend response body to be closed since it wasn't forwarded")
+	}
 }
@@ -0,0 +1,231 @@
+package offloader
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+var (
+	ErrNoResponseWriter  = errors.New("no http.ResponseWriter available for upgrade; use Offloader.Wrap or Offloader.ServeHTTP")
+	ErrHijackUnsupported = errors.New("response writer does not support hijacking")
+	ErrUpgradeFailed     = errors.New("offload target did not return 101 Switching Protocols")
+)
+
+// errUpgradeServed is returned by serveUpgrade once it has taken over the client connection, so that
+// httputil.ReverseProxy routes it to the ErrorHandler installed by Offloader.Wrap, which ignores it, instead of
+// trying to write a response of its own on a connection that's already been handed off. It never escapes this package.
+var errUpgradeServed = errors.New("offload upgrade served")
+
+// upgradeRequestHeaders are copied from the client's original request onto the offload target's upgrade request;
+// they're what identify and negotiate the upgrade itself.
+var upgradeRequestHeaders = []string{
+	"Sec-Websocket-Key",
+	"Sec-Websocket-Version",
+	"Sec-Websocket-Protocol",
+	"Sec-Websocket-Extensions",
+}
+
+// serveUpgrade handles a backend response carrying Offload-Upgrade: it hijacks the client connection, dials the
+// offload target named by Offload-Url, performs an HTTP/1.1 upgrade handshake there, and then bidirectionally
+// copies bytes between the two connections until either side closes. Because the client connection is fully
+// handled here, it returns errUpgradeServed rather than nil once the client connection has been hijacked, so that
+// httputil.ReverseProxy doesn't write anything further to it.
+func (o *Offloader) serveUpgrade(backendResponse *http.Response) error {
+	targetURL := backendResponse.Header.Get(HeaderRequestedUrl)
+	if targetURL == "" {
+		return ErrMissingUrl
+	}
+
+	w, ok := responseWriterFromRequest(backendResponse.Request)
+	if !ok {
+		return ErrNoResponseWriter
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		return ErrHijackUnsupported
+	}
+
+	var origReq *http.Request
+	if backendResponse.Request != nil {
+		origReq = backendResponse.Request
+	}
+
+	ctx := context.Background()
+	if origReq != nil {
+		ctx = origReq.Context()
+	}
+
+	upgradeRequest, err := o.buildUpgradeRequest(ctx, targetURL, origReq, backendResponse)
+	if err != nil {
+		return err
+	}
+
+	targetConn, err := o.dialUpgradeTarget(ctx, upgradeRequest.URL)
+	if err != nil {
+		return err
+	}
+
+	stopHandshakeCancel := closeConnWhenDone(ctx, targetConn)
+
+	if err := upgradeRequest.Write(targetConn); err != nil {
+		stopHandshakeCancel()
+		targetConn.Close()
+		return err
+	}
+
+	targetReader := bufio.NewReader(targetConn)
+	targetResponse, err := http.ReadResponse(targetReader, upgradeRequest)
+	if err != nil {
+		stopHandshakeCancel()
+		targetConn.Close()
+		return err
+	}
+
+	if targetResponse.StatusCode != http.StatusSwitchingProtocols {
+		stopHandshakeCancel()
+		targetResponse.Body.Close()
+		targetConn.Close()
+		return ErrUpgradeFailed
+	}
+
+	clientConn, clientBuf, err := hijacker.Hijack()
+	if err != nil {
+		stopHandshakeCancel()
+		targetConn.Close()
+		return err
+	}
+
+	// The handshake is done and the client connection is now ours for the lifetime of the splice; stop tearing
+	// down targetConn on ctx cancellation so a long-lived upgraded connection isn't cut short by it.
+	stopHandshakeCancel()
+
+	if err := writeUpgradeResponse(clientConn, targetResponse); err != nil {
+		o.logf("writing upgrade response to client: %v", err)
+		clientConn.Close()
+		targetConn.Close()
+		return errUpgradeServed
+	}
+
+	splice(clientConn, clientBuf, targetConn, targetReader)
+
+	return errUpgradeServed
+}
+
+// buildUpgradeRequest builds the HTTP/1.1 request sent to the offload target to perform the upgrade handshake. It
+// carries the client's Sec-WebSocket-* headers listed in upgradeRequestHeaders (no other client headers are copied)
+// and the backend's Offload-X-* headers, the same way an ordinary offload request does.
+func (o *Offloader) buildUpgradeRequest(ctx context.Context, targetURL string, origReq *http.Request, backendResponse *http.Response) (*http.Request, error) {
+	upgradeRequest, err := http.NewRequestWithContext(ctx, http.MethodGet, targetURL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	upgradeRequest.Header.Set("Connection", "Upgrade")
+	upgradeRequest.Header.Set("Upgrade", backendResponse.Header.Get(HeaderUpgrade))
+
+	if origReq != nil {
+		for _, name := range upgradeRequestHeaders {
+			if v := origReq.Header.Get(name); v != "" {
+				upgradeRequest.Header.Set(name, v)
+			}
+		}
+	}
+
+	forbidden := hopByHopHeaderSet(backendResponse.Header)
+	for key, val := range backendResponse.Header {
+		if !strings.HasPrefix(key, HeaderCustomHeaderPrefix) {
+			continue
+		}
+		trimmedKey := strings.TrimPrefix(key, HeaderCustomHeaderPrefix)
+		if !forbidden[http.CanonicalHeaderKey(trimmedKey)] {
+			upgradeRequest.Header.Set(trimmedKey, val[0])
+		}
+	}
+
+	return upgradeRequest, nil
+}
+
+// dialUpgradeTarget opens the raw connection used for the upgrade handshake: o.Dial if set, otherwise a plain TCP
+// dial for ws/http targets or a TLS dial for wss/https targets. When o.Dial isn't set, the dial honors ctx's
+// cancellation and deadline; o.Dial itself has no context parameter, so a dial performed through it can't be
+// interrupted this way, but the handshake that follows still is (see closeConnWhenDone).
+func (o *Offloader) dialUpgradeTarget(ctx context.Context, target *url.URL) (net.Conn, error) {
+	addr := target.Host
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		if target.Scheme == "wss" || target.Scheme == "https" {
+			addr = net.JoinHostPort(addr, "443")
+		} else {
+			addr = net.JoinHostPort(addr, "80")
+		}
+	}
+
+	if o.Dial != nil {
+		return o.Dial("tcp", addr)
+	}
+
+	if target.Scheme == "wss" || target.Scheme == "https" {
+		d := tls.Dialer{Config: &tls.Config{ServerName: target.Hostname()}}
+		return d.DialContext(ctx, "tcp", addr)
+	}
+
+	var d net.Dialer
+	return d.DialContext(ctx, "tcp", addr)
+}
+
+// closeConnWhenDone arranges for conn to be forced closed if ctx is canceled or its deadline passes before the
+// returned stop function is called, bounding the offload target dial/handshake to the lifetime of the client's
+// request the same way the rest of the package already does for plain offload requests. Call stop once the
+// handshake completes so a long-lived upgraded connection isn't torn down by the original request's context.
+func closeConnWhenDone(ctx context.Context, conn net.Conn) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	return func() { close(done) }
+}
+
+// writeUpgradeResponse relays the offload target's 101 response to the client connection, since the client's
+// handshake is terminated at us rather than passed through untouched.
+func writeUpgradeResponse(clientConn net.Conn, targetResponse *http.Response) error {
+	if _, err := io.WriteString(clientConn, "HTTP/1.1 101 Switching Protocols\r\n"); err != nil {
+		return err
+	}
+	if err := targetResponse.Header.Write(clientConn); err != nil {
+		return err
+	}
+	_, err := io.WriteString(clientConn, "\r\n")
+	return err
+}
+
+// splice copies bytes bidirectionally between the client and target connections, including any bytes already
+// buffered by either side's bufio.Reader, until either direction reports an error or EOF.
+func splice(clientConn net.Conn, clientBuf *bufio.ReadWriter, targetConn net.Conn, targetReader *bufio.Reader) {
+	done := make(chan struct{}, 2)
+
+	go func() {
+		io.Copy(targetConn, clientBuf)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(clientConn, targetReader)
+		done <- struct{}{}
+	}()
+
+	<-done
+	clientConn.Close()
+	targetConn.Close()
+	<-done
+}
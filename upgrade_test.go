@@ -0,0 +1,280 @@
+package offloader
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"testing"
+)
+
+// TestServeUpgradeSplicesBothDirections exercises the full Offload-Upgrade path: a backend asks the offloader to
+// hijack the client connection and hand it off to a fake offload target over a net.Pipe (standing in for the
+// target's TCP connection), then asserts bytes written by the client reach the target and vice versa.
+func TestServeUpgradeSplicesBothDirections(t *testing.T) {
+	backendServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(HeaderOffloadRequested, "1")
+		w.Header().Set(HeaderRequestedUrl, "ws://upgrade.invalid/socket")
+		w.Header().Set(HeaderUpgrade, "websocket")
+		w.Header().Set(HeaderCustomHeaderPrefix+"Custom", "carried-through")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer backendServer.Close()
+
+	offloaderSide, targetSide := net.Pipe()
+
+	targetErrs := make(chan error, 1)
+	go func() {
+		targetErrs <- serveFakeUpgradeTarget(targetSide)
+	}()
+
+	target, err := url.Parse(backendServer.URL)
+	if err != nil {
+		t.Fatalf("unexpected url parse error: %v", err)
+	}
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	o := &Offloader{
+		Dial: func(network, addr string) (net.Conn, error) {
+			return offloaderSide, nil
+		},
+	}
+
+	frontServer := httptest.NewServer(o.Wrap(proxy))
+	defer frontServer.Close()
+
+	frontURL, err := url.Parse(frontServer.URL)
+	if err != nil {
+		t.Fatalf("unexpected url parse error: %v", err)
+	}
+
+	conn, err := net.Dial("tcp", frontURL.Host)
+	if err != nil {
+		t.Fatalf("unexpected dial error: %v", err)
+	}
+	defer conn.Close()
+
+	fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: %s\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n"+
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n", frontURL.Host)
+
+	clientReader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(clientReader, nil)
+	if err != nil {
+		t.Fatalf("unexpected response read error: %v", err)
+	}
+
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("got status %d, wanted %d", resp.StatusCode, http.StatusSwitchingProtocols)
+	}
+
+	if _, err := conn.Write([]byte("hello-from-client")); err != nil {
+		t.Fatalf("unexpected write error: %v", err)
+	}
+
+	want := "echo:hello-from-client"
+	buf := make([]byte, 0, len(want))
+	tmp := make([]byte, 1024)
+	for len(buf) < len(want) {
+		n, err := clientReader.Read(tmp)
+		if err != nil {
+			t.Fatalf("unexpected read error: %v", err)
+		}
+		buf = append(buf, tmp[:n]...)
+	}
+
+	if got := string(buf); got != want {
+		t.Errorf("got %q, wanted %q", got, want)
+	}
+
+	if err := <-targetErrs; err != nil {
+		t.Errorf("fake upgrade target reported an error: %v", err)
+	}
+}
+
+// serveFakeUpgradeTarget plays the part of the offload target on the other end of a net.Pipe: it reads the
+// upgrade request, validates the headers carried through from the client and backend, sends back a 101 response,
+// and echoes one message from the client to prove both directions of the splice work.
+func serveFakeUpgradeTarget(conn net.Conn) error {
+	reader := bufio.NewReader(conn)
+	req, err := http.ReadRequest(reader)
+	if err != nil {
+		return fmt.Errorf("reading upgrade request: %w", err)
+	}
+
+	if got, want := req.Header.Get("Sec-Websocket-Key"), "dGhlIHNhbXBsZSBub25jZQ=="; got != want {
+		return fmt.Errorf("Sec-WebSocket-Key: got %q, wanted %q", got, want)
+	}
+	if got, want := req.Header.Get("Custom"), "carried-through"; got != want {
+		return fmt.Errorf("Custom header: got %q, wanted %q", got, want)
+	}
+
+	if _, err := fmt.Fprintf(conn, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n"); err != nil {
+		return fmt.Errorf("writing upgrade response: %w", err)
+	}
+
+	buf := make([]byte, 1024)
+	var n int
+	for n == 0 {
+		var err error
+		n, err = reader.Read(buf)
+		if err != nil {
+			return fmt.Errorf("reading client frame: %w", err)
+		}
+	}
+
+	if _, err := fmt.Fprintf(conn, "echo:%s", buf[:n]); err != nil {
+		return fmt.Errorf("writing echo frame: %w", err)
+	}
+
+	return nil
+}
+
+func TestServeUpgradeRequiresResponseWriter(t *testing.T) {
+	o := &Offloader{}
+
+	backendResponse := &http.Response{
+		Header: http.Header{
+			HeaderOffloadRequested: []string{"1"},
+			HeaderUpgrade:          []string{"websocket"},
+			HeaderRequestedUrl:     []string{"ws://upgrade.invalid/socket"},
+		},
+	}
+
+	if err := o.ModifyResponse(backendResponse); err != ErrNoResponseWriter {
+		t.Errorf("expected %v, got %v", ErrNoResponseWriter, err)
+	}
+}
+
+func TestServeUpgradeRequiresUrl(t *testing.T) {
+	o := &Offloader{}
+
+	backendResponse := &http.Response{
+		Header: http.Header{
+			HeaderOffloadRequested: []string{"1"},
+			HeaderUpgrade:          []string{"websocket"},
+		},
+	}
+
+	if err := o.ModifyResponse(backendResponse); err != ErrMissingUrl {
+		t.Errorf("expected %v, got %v", ErrMissingUrl, err)
+	}
+}
+
+func TestServeUpgradeFailsOnNonSwitchingProtocolsResponse(t *testing.T) {
+	offloaderSide, targetSide := net.Pipe()
+	defer offloaderSide.Close()
+
+	go func() {
+		reader := bufio.NewReader(targetSide)
+		if _, err := http.ReadRequest(reader); err != nil {
+			return
+		}
+		io.WriteString(targetSide, "HTTP/1.1 400 Bad Request\r\nContent-Length: 0\r\n\r\n")
+	}()
+
+	backendServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(HeaderOffloadRequested, "1")
+		w.Header().Set(HeaderRequestedUrl, "ws://upgrade.invalid/socket")
+		w.Header().Set(HeaderUpgrade, "websocket")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer backendServer.Close()
+
+	target, err := url.Parse(backendServer.URL)
+	if err != nil {
+		t.Fatalf("unexpected url parse error: %v", err)
+	}
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	o := &Offloader{
+		Dial: func(network, addr string) (net.Conn, error) {
+			return offloaderSide, nil
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			if err != ErrUpgradeFailed {
+				t.Errorf("expected %v, got %v", ErrUpgradeFailed, err)
+			}
+			w.WriteHeader(http.StatusBadGateway)
+		},
+	}
+
+	frontServer := httptest.NewServer(o.Wrap(proxy))
+	defer frontServer.Close()
+
+	resp, err := http.Get(frontServer.URL)
+	if err != nil {
+		t.Fatalf("unexpected request error: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("got status %d, wanted %d", resp.StatusCode, http.StatusBadGateway)
+	}
+}
+
+// closeAfterHijackWriter wraps an http.ResponseWriter so that the connection it hands back from Hijack is already
+// closed, simulating a client that disconnects the instant the hijack completes.
+type closeAfterHijackWriter struct {
+	http.ResponseWriter
+}
+
+func (w *closeAfterHijackWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, buf, err := w.ResponseWriter.(http.Hijacker).Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	conn.Close()
+	return conn, buf, nil
+}
+
+// TestServeUpgradeReportsServedOnPostHijackWriteFailure ensures that once the client connection has been hijacked,
+// a failure to write the upgrade response to it (e.g. because the client already disconnected) is still treated as
+// "served" rather than being passed on to ErrorHandler, which would then try to write a response on the already
+// hijacked connection.
+func TestServeUpgradeReportsServedOnPostHijackWriteFailure(t *testing.T) {
+	offloaderSide, targetSide := net.Pipe()
+	defer offloaderSide.Close()
+
+	go func() {
+		reader := bufio.NewReader(targetSide)
+		if _, err := http.ReadRequest(reader); err != nil {
+			return
+		}
+		io.WriteString(targetSide, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+	}()
+
+	backendServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(HeaderOffloadRequested, "1")
+		w.Header().Set(HeaderRequestedUrl, "ws://upgrade.invalid/socket")
+		w.Header().Set(HeaderUpgrade, "websocket")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer backendServer.Close()
+
+	target, err := url.Parse(backendServer.URL)
+	if err != nil {
+		t.Fatalf("unexpected url parse error: %v", err)
+	}
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	o := &Offloader{
+		Dial: func(network, addr string) (net.Conn, error) {
+			return offloaderSide, nil
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			t.Errorf("ErrorHandler should not run once the connection has been hijacked, got: %v", err)
+		},
+	}
+
+	wrapped := o.Wrap(proxy)
+	frontServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		wrapped.ServeHTTP(&closeAfterHijackWriter{ResponseWriter: w}, r)
+	}))
+	defer frontServer.Close()
+
+	if resp, err := http.Get(frontServer.URL); err == nil {
+		resp.Body.Close()
+		t.Fatalf("expected the request to fail since the client connection was closed mid-upgrade")
+	}
+}